@@ -0,0 +1,203 @@
+package nsqlookupd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// authorizationRefreshInterval is not consulted by the re-validation path:
+// cached authorizations are re-queried from authd once the TTL authd
+// returned for them has passed (see NeedsAuthRefresh and
+// RefreshAuthorizations), not on a fixed interval.
+const authorizationRefreshInterval = 60 * time.Second
+
+// Authorization describes the set of topics (by regex) a peer is permitted
+// to act on and which permissions (e.g. "register", "unregister") it holds
+// over them.
+type Authorization struct {
+	Topic       string   `json:"topic"`
+	Permissions []string `json:"permissions"`
+	expires     time.Time
+
+	topicRegex *regexp.Regexp
+}
+
+func (a *Authorization) HasPermission(permission string) bool {
+	for _, p := range a.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Authorization) IsAllowed(topic string) bool {
+	if a.topicRegex == nil {
+		re, err := regexp.Compile(a.Topic)
+		if err != nil {
+			return false
+		}
+		a.topicRegex = re
+	}
+	return a.topicRegex.MatchString(topic)
+}
+
+type authResponse struct {
+	TTL            int              `json:"ttl"`
+	Authorizations []*Authorization `json:"authorizations"`
+	Identity       string           `json:"identity"`
+}
+
+// authRequest is the body POSTed to the auth HTTP endpoint. Sending the
+// secret this way, rather than as a URL query parameter, keeps it out of
+// proxy/access logs sitting in front of the auth service.
+type authRequest struct {
+	RemoteIP string `json:"remote_ip"`
+	TLS      bool   `json:"tls"`
+	Secret   string `json:"secret"`
+}
+
+// authdEndpoint turns a configured --auth-http-address entry into a full
+// /auth URL. An address that already names a scheme (e.g. "https://..." for
+// an auth service that itself requires TLS) is used as-is; a bare host:port
+// is assumed to be plain HTTP, matching nsqd's default.
+func authdEndpoint(authAddr string) string {
+	if strings.Contains(authAddr, "://") {
+		return strings.TrimRight(authAddr, "/") + "/auth"
+	}
+	return fmt.Sprintf("http://%s/auth", authAddr)
+}
+
+// queryAuthd POSTs the client's secret (along with connection metadata) to
+// the configured auth HTTP address and returns the authorizations it grants.
+// This is the nsqlookupd analogue of nsqd's QueryAuthd.
+func queryAuthd(authHTTPAddresses []string, remoteIP string, isTLS bool, secret string, connectTimeout time.Duration, requestTimeout time.Duration) ([]*Authorization, error) {
+	if len(authHTTPAddresses) == 0 {
+		return nil, fmt.Errorf("no auth http address configured")
+	}
+
+	endpoint := authdEndpoint(authHTTPAddresses[0])
+
+	reqBody, err := json.Marshal(authRequest{RemoteIP: remoteIP, TLS: isTLS, Secret: secret})
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{Timeout: connectTimeout}).Dial,
+		},
+		Timeout: requestTimeout,
+	}
+
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("auth error %d: %s", resp.StatusCode, string(body))
+	}
+
+	var ar authResponse
+	if err := json.Unmarshal(body, &ar); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, a := range ar.Authorizations {
+		a.expires = now.Add(time.Duration(ar.TTL) * time.Second)
+	}
+
+	return ar.Authorizations, nil
+}
+
+// SetAuthorizations replaces the client's cached authorization set, as
+// granted by a successful AUTH or periodic re-validation.
+func (c *ClientV1) SetAuthorizations(authorizations []*Authorization) {
+	c.Lock()
+	defer c.Unlock()
+	c.authorizations = authorizations
+}
+
+// HasAuthorizations reports whether the client currently holds at least one
+// cached authorization. A successful AUTH for which authd granted an empty
+// set leaves this false.
+func (c *ClientV1) HasAuthorizations() bool {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.authorizations) > 0
+}
+
+// IsAuthorizedFor reports whether the client currently holds a cached
+// authorization granting permission over topic. Expired authorizations are
+// treated as absent; the caller (REGISTER/UNREGISTER) is responsible for
+// re-querying authd via RefreshAuthorizations on the next command.
+func (c *ClientV1) IsAuthorizedFor(topic string, permission string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, a := range c.authorizations {
+		if time.Now().After(a.expires) {
+			continue
+		}
+		if a.IsAllowed(topic) && a.HasPermission(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsAuthRefresh reports whether any cached authorization has passed its
+// TTL and should be re-queried from authd before being trusted further.
+func (c *ClientV1) NeedsAuthRefresh() bool {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.authorizations) == 0 {
+		return false
+	}
+	for _, a := range c.authorizations {
+		if time.Now().After(a.expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// RefreshAuthorizations re-queries authd for this client's authorizations
+// using its previously-supplied secret, replacing the cached set on success.
+// nsqlookupd calls this lazily from REGISTER/UNREGISTER once the cached
+// authorizations have passed their TTL, matching nsqd's periodic
+// re-validation behavior without needing a dedicated timer per connection.
+func (c *ClientV1) RefreshAuthorizations(authHTTPAddresses []string, connectTimeout, requestTimeout time.Duration) error {
+	c.Lock()
+	secret := c.authSecret
+	remoteIP := c.authRemoteIP
+	isTLS := c.isTLS
+	c.Unlock()
+
+	if secret == "" {
+		return fmt.Errorf("client has no cached secret to refresh")
+	}
+
+	authorizations, err := queryAuthd(authHTTPAddresses, remoteIP, isTLS, secret, connectTimeout, requestTimeout)
+	if err != nil {
+		return err
+	}
+
+	c.SetAuthorizations(authorizations)
+	return nil
+}
@@ -0,0 +1,366 @@
+package nsqlookupd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// antiEntropyInterval is how often a peer exchanges per-topic Merkle-hash
+// summaries with every other peer to catch mutations a delta pull missed
+// (e.g. because the peer was down when the delta was gossiped and its
+// ring buffer slot has since been overwritten).
+const antiEntropyInterval = 30 * time.Second
+
+// peerSyncInterval is how often a peer pulls deltas from every other peer
+// via SYNC <peer_id> <since_seq> once the initial full-state pull has
+// completed.
+const peerSyncInterval = 2 * time.Second
+
+// mutationRingSize bounds how many deltas each peer retains for others to
+// pull. Once a peer falls further behind than this it can no longer be
+// caught up by delta gossip and anti-entropy has to reconcile it instead.
+const mutationRingSize = 4096
+
+// mutation is one RegistrationDB change, tagged so that every peer in the
+// cluster can apply it in the same order and so that last-writer-wins can
+// compare two conflicting mutations for the same (topic, pid, producer)
+// triple.
+//
+// Two different identities are carried here and must not be confused:
+// OriginLookupdId/Epoch/Seq address *this gossip record* (which lookupd
+// produced it, and where in that lookupd's ring), while ProducerPeerId is
+// the nsqd producer's own Id — the third element of the RegistrationDB
+// triple that applyReplicated's locally-authoritative check keys on.
+type mutation struct {
+	OriginLookupdId string `json:"origin_lookupd_id"`
+	Epoch           uint64 `json:"epoch"`
+	Seq             uint64 `json:"seq"`
+	WallTS          int64  `json:"wall_ts"`
+	Type            string `json:"type"` // add_producer, remove_producer, add_channel, remove_channel, tombstone_producer, resync
+	Topic           string `json:"topic"`
+	PartitionID     string `json:"partition_id"`
+	ProducerPeerId  string `json:"producer_peer_id"`
+	Channel         string `json:"channel,omitempty"`
+}
+
+// mutationRing is a fixed-capacity ring buffer of this peer's own
+// mutations, indexed by seq, that remote peers pull from via SYNC. epoch is
+// stamped once at process start (see newMutationRing) so that a peer which
+// restarted mid-gossip — and whose seq counter has reset to 0 — can be
+// detected immediately by callers instead of silently producing a seq that
+// looks "behind" to a peer that remembers a higher one from before the
+// restart.
+type mutationRing struct {
+	sync.Mutex
+	epoch uint64
+	seq   uint64
+	items []mutation // ring of size mutationRingSize, slot = seq % mutationRingSize
+}
+
+func newMutationRing(epoch uint64) *mutationRing {
+	return &mutationRing{epoch: epoch, items: make([]mutation, mutationRingSize)}
+}
+
+// Append assigns the next monotonic seq (within this ring's epoch) to m and
+// stores it, returning the assigned mutation for gossip fan-out.
+func (r *mutationRing) Append(m mutation) mutation {
+	r.Lock()
+	defer r.Unlock()
+	r.seq++
+	m.Epoch = r.epoch
+	m.Seq = r.seq
+	r.items[m.Seq%mutationRingSize] = m
+	return m
+}
+
+// Since returns this ring's current epoch along with every retained
+// mutation with seq > since, oldest first. If the ring has wrapped past
+// since entirely, the caller must fall back to anti-entropy instead of
+// trusting the (possibly incomplete) result.
+func (r *mutationRing) Since(since uint64) (epoch uint64, out []mutation, ok bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.seq-since > mutationRingSize {
+		return r.epoch, nil, false // caller missed too much; delta gossip can't catch it up
+	}
+
+	out = make([]mutation, 0, r.seq-since)
+	for s := since + 1; s <= r.seq; s++ {
+		out = append(out, r.items[s%mutationRingSize])
+	}
+	return r.epoch, out, true
+}
+
+// clusterPeer tracks gossip state for one configured --lookupd-peer.
+type clusterPeer struct {
+	id        string
+	addr      string
+	lastEpoch uint64 // last epoch we observed this peer report; a change means it restarted
+	lastSeq   uint64 // highest seq we've pulled from this peer within lastEpoch
+	snapped   int32  // atomic bool: has the initial full-state SYNC_SNAPSHOT pull completed
+	connected int32  // atomic bool
+}
+
+// cluster is the anti-entropy subsystem wired into nsqlookupd's
+// RegistrationDB: every local mutation (one made by a live TCP client) is
+// recorded here and gossiped to peers, and every mutation pulled from a
+// peer is applied to DB unless a locally-originated entry for the same
+// (topic, pid, producer_peer_id) triple already wins under
+// last-writer-wins.
+type cluster struct {
+	ctx    *Context
+	selfId string
+	ring   *mutationRing
+
+	mtx   sync.RWMutex
+	peers map[string]*clusterPeer
+
+	exitChan chan int
+}
+
+// newCluster builds the gossip subsystem for this lookupd instance. epoch
+// should be a value that's unique to this process's lifetime (e.g. this
+// lookupd's start time in UnixNano) so that peers can distinguish "still
+// the same running process" from "restarted and its ring reset to seq 0".
+func newCluster(ctx *Context, selfId string, epoch uint64, peerAddrs []string) *cluster {
+	c := &cluster{
+		ctx:      ctx,
+		selfId:   selfId,
+		ring:     newMutationRing(epoch),
+		peers:    make(map[string]*clusterPeer),
+		exitChan: make(chan int),
+	}
+	for _, addr := range peerAddrs {
+		c.peers[addr] = &clusterPeer{addr: addr}
+	}
+	return c
+}
+
+// StartCluster is the single call nsqlookupd's startup needs to make to
+// turn on peer gossip: it builds the cluster (skipping entirely if
+// peerAddrs is empty, leaving ctx.nsqlookupd.cluster nil and every
+// RecordLocal call a no-op), stores it on ctx.nsqlookupd, and launches its
+// gossip/anti-entropy loops in a new goroutine. Call it once, after DB and
+// opts are in place on ctx.nsqlookupd and before the TCP listener starts
+// accepting REGISTER/UNREGISTER traffic, passing this instance's own id,
+// a process-lifetime-unique epoch (e.g. time.Now().UnixNano()), and the
+// configured --lookupd-peer addresses.
+func StartCluster(ctx *Context, selfId string, epoch uint64, peerAddrs []string) {
+	if len(peerAddrs) == 0 {
+		return
+	}
+	c := newCluster(ctx, selfId, epoch, peerAddrs)
+	ctx.nsqlookupd.cluster = c
+	go c.Run()
+}
+
+// RecordLocal is called directly by LookupProtocolV1's REGISTER, UNREGISTER,
+// REGISTER_MULTI, UNREGISTER_MULTI, and TOMBSTONE handlers after a mutation
+// driven by a live TCP client succeeds — not by RegistrationDB itself,
+// since that keeps RegistrationDB's API unaware of cluster/gossip concerns,
+// consistent with how it already returns a bool to its protocol-layer
+// callers rather than notifying anything internally. producerPeerId is the
+// REGISTERing/UNREGISTERing nsqd's own Id: it is the triple key
+// applyReplicated's locally-authoritative guard checks, not this lookupd's
+// own selfId.
+func (c *cluster) RecordLocal(mutationType, topic, partitionID, channel, producerPeerId string) {
+	if c == nil {
+		return // cluster gossip isn't configured (no --lookupd-peer); nothing to record
+	}
+	m := c.ring.Append(mutation{
+		OriginLookupdId: c.selfId,
+		WallTS:          time.Now().UnixNano(),
+		Type:            mutationType,
+		Topic:           topic,
+		PartitionID:     partitionID,
+		ProducerPeerId:  producerPeerId,
+		Channel:         channel,
+	})
+	nsqlookupLog.Logf("CLUSTER: recorded local mutation %s topic:%s pid:%s producer:%s seq:%d",
+		m.Type, m.Topic, m.PartitionID, m.ProducerPeerId, m.Seq)
+}
+
+// Run starts the per-peer gossip loops (initial full pull, then periodic
+// delta pulls) and the anti-entropy loop. It blocks until Stop is called.
+// The caller (nsqlookupd's startup, once --lookupd-peer is configured)
+// runs this in its own goroutine alongside the TCP/HTTP listeners.
+func (c *cluster) Run() {
+	var wg sync.WaitGroup
+
+	c.mtx.RLock()
+	peers := make([]*clusterPeer, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	c.mtx.RUnlock()
+
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(p *clusterPeer) {
+			defer wg.Done()
+			c.gossipLoop(p)
+		}(peer)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.antiEntropyLoop()
+	}()
+
+	wg.Wait()
+}
+
+func (c *cluster) Stop() {
+	close(c.exitChan)
+}
+
+// gossipLoop performs PEER_IDENTIFY against addr, an initial full-state
+// SYNC_SNAPSHOT pull, and then periodic delta SYNC pulls. Every applied
+// mutation is merged via applyReplicated. A change in the peer's reported
+// epoch means it restarted since our last pull — its ring no longer
+// contains anything we previously tracked by seq, so the peer is treated as
+// unsynced again and re-snapshotted rather than delta-pulled against a
+// since_seq the peer's restarted process has no memory of.
+func (c *cluster) gossipLoop(peer *clusterPeer) {
+	ticker := time.NewTicker(peerSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.exitChan:
+			return
+		case <-ticker.C:
+			var epoch uint64
+			var mutations []mutation
+			var err error
+
+			if atomic.LoadInt32(&peer.snapped) == 0 {
+				epoch, mutations, err = c.pullSnapshot(peer)
+				if err != nil {
+					nsqlookupLog.LogErrorf(" CLUSTER: initial SYNC_SNAPSHOT from peer(%s) failed - %s", peer.addr, err)
+					atomic.StoreInt32(&peer.connected, 0)
+					continue
+				}
+				atomic.StoreInt32(&peer.snapped, 1)
+				peer.lastEpoch = epoch
+			} else {
+				since := atomic.LoadUint64(&peer.lastSeq)
+				epoch, mutations, err = c.pullSince(peer, since)
+				if err != nil {
+					nsqlookupLog.LogErrorf(" CLUSTER: SYNC with peer(%s) failed - %s", peer.addr, err)
+					atomic.StoreInt32(&peer.connected, 0)
+					continue
+				}
+
+				if epoch != peer.lastEpoch {
+					nsqlookupLog.Logf("CLUSTER: peer(%s) epoch changed %d -> %d, treating as restarted",
+						peer.addr, peer.lastEpoch, epoch)
+					atomic.StoreInt32(&peer.snapped, 0)
+					atomic.StoreUint64(&peer.lastSeq, 0)
+					peer.lastEpoch = epoch
+					epoch, mutations, err = c.pullSnapshot(peer)
+					if err != nil {
+						nsqlookupLog.LogErrorf(" CLUSTER: re-snapshot from peer(%s) failed - %s", peer.addr, err)
+						continue
+					}
+					atomic.StoreInt32(&peer.snapped, 1)
+				}
+			}
+			atomic.StoreInt32(&peer.connected, 1)
+
+			for _, m := range mutations {
+				c.applyReplicated(m)
+				if m.Seq > atomic.LoadUint64(&peer.lastSeq) {
+					atomic.StoreUint64(&peer.lastSeq, m.Seq)
+				}
+			}
+		}
+	}
+}
+
+// pullSince issues PEER_IDENTIFY + SYNC <peer_id> <since_seq> over the TCP
+// protocol and decodes the resulting epoch and mutation batch.
+func (c *cluster) pullSince(peer *clusterPeer, since uint64) (uint64, []mutation, error) {
+	return pullPeerMutations(peer.addr, c.selfId, since)
+}
+
+// pullSnapshot issues PEER_IDENTIFY + SYNC_SNAPSHOT, returning a full
+// mutation snapshot of every topic the peer currently holds. Used the first
+// time we gossip with a peer (and again after detecting it restarted)
+// instead of a delta SYNC, since the ring has no memory of registrations
+// made before we started watching it.
+func (c *cluster) pullSnapshot(peer *clusterPeer) (uint64, []mutation, error) {
+	return pullPeerSnapshot(peer.addr, c.selfId)
+}
+
+// antiEntropyLoop periodically exchanges per-topic Merkle-hash summaries
+// with every peer and pulls the subtrees that don't match, catching
+// mutations delta gossip missed because a peer was down when they fired.
+func (c *cluster) antiEntropyLoop() {
+	ticker := time.NewTicker(antiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.exitChan:
+			return
+		case <-ticker.C:
+			c.runAntiEntropyPass()
+		}
+	}
+}
+
+func (c *cluster) runAntiEntropyPass() {
+	localHashes := c.ctx.nsqlookupd.DB.TopicMerkleHashes()
+
+	c.mtx.RLock()
+	peers := make([]*clusterPeer, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	c.mtx.RUnlock()
+
+	for _, peer := range peers {
+		remoteHashes, err := fetchPeerTopicHashes(peer.addr, c.selfId)
+		if err != nil {
+			nsqlookupLog.LogErrorf(" CLUSTER: anti-entropy hash exchange with peer(%s) failed - %s", peer.addr, err)
+			continue
+		}
+		for topic, remoteHash := range remoteHashes {
+			if localHashes[topic] != remoteHash {
+				mutations, err := fetchPeerTopicState(peer.addr, c.selfId, topic)
+				if err != nil {
+					nsqlookupLog.LogErrorf(" CLUSTER: anti-entropy pull of topic:%s from peer(%s) failed - %s",
+						topic, peer.addr, err)
+					continue
+				}
+				for _, m := range mutations {
+					c.applyReplicated(m)
+				}
+			}
+		}
+	}
+}
+
+// applyReplicated merges a mutation pulled from a peer into RegistrationDB
+// via ApplyReplicatedMutation, passing it the mutation's producer_peer_id,
+// seq and wall_ts. OriginLookupdId is used only to skip this lookupd's own
+// mutations; it is not passed to ApplyReplicatedMutation. A
+// locally-originated registration for the same (topic, pid,
+// producer_peer_id) triple always wins over a replicated one — a lookupd
+// must never remove a producer it can still see over its own live
+// connection just because a peer's gossip said otherwise.
+func (c *cluster) applyReplicated(m mutation) {
+	if m.OriginLookupdId == c.selfId {
+		return
+	}
+	if c.ctx.nsqlookupd.DB.HasLocalRegistration(m.Topic, m.PartitionID, m.ProducerPeerId) {
+		nsqlookupLog.Logf("CLUSTER: ignoring replicated %s for topic:%s pid:%s producer:%s, locally authoritative",
+			m.Type, m.Topic, m.PartitionID, m.ProducerPeerId)
+		return
+	}
+	c.ctx.nsqlookupd.DB.ApplyReplicatedMutation(m.ProducerPeerId, m.Seq, m.WallTS, m.Type, m.Topic, m.PartitionID, m.Channel)
+}
@@ -0,0 +1,198 @@
+package nsqlookupd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// clusterDialTimeout bounds how long a gossip/anti-entropy round may spend
+// connecting to a peer before giving up for this round; the next tick
+// simply tries again.
+const clusterDialTimeout = 2 * time.Second
+
+// readFramedResponse reads one int32-length-prefixed response frame, the
+// same framing LookupProtocolV1 commands use for their bodies.
+func readFramedResponse(reader *bufio.Reader) ([]byte, error) {
+	var n int32
+	if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// dialPeer opens a plain "  V1" connection to a peer nsqlookupd and sends
+// PEER_IDENTIFY, the same handshake a regular client does with IDENTIFY.
+func dialPeer(addr string, selfId string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", addr, clusterDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := conn.Write([]byte("  V1")); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	body, err := json.Marshal(struct {
+		PeerId string `json:"peer_id"`
+	}{selfId})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if _, err := conn.Write([]byte("PEER_IDENTIFY\n")); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := binary.Write(conn, binary.BigEndian, int32(len(body))); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if _, err := conn.Write(body); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	if _, err := readFramedResponse(reader); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, reader, nil
+}
+
+// pullPeerMutations opens a connection to peerAddr, performs PEER_IDENTIFY,
+// and issues SYNC <peer_id> <since_seq>, returning the peer's current ring
+// epoch alongside the delta batch. The caller must compare the returned
+// epoch against the last one it saw for this peer: a mismatch means the
+// peer restarted and its seq counter reset, so since_seq no longer means
+// anything to it and the caller needs to re-pull from 0.
+func pullPeerMutations(peerAddr, selfId string, since uint64) (uint64, []mutation, error) {
+	conn, reader, err := dialPeer(peerAddr, selfId)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	cmd := fmt.Sprintf("SYNC %s %s\n", selfId, strconv.FormatUint(since, 10))
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := readFramedResponse(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var syncResp struct {
+		Epoch     uint64     `json:"epoch"`
+		Mutations []mutation `json:"mutations"`
+	}
+	if len(resp) > 0 {
+		if err := json.Unmarshal(resp, &syncResp); err != nil {
+			return 0, nil, err
+		}
+	}
+	return syncResp.Epoch, syncResp.Mutations, nil
+}
+
+// pullPeerSnapshot issues SYNC_SNAPSHOT against peerAddr, returning the
+// peer's current ring epoch and a full mutation snapshot of every topic it
+// holds. This is what a peer must use for its very first pull against
+// another peer: the mutation ring only retains recent deltas, so pulling
+// "since 0" from it gets nothing for registrations that predate this
+// peer's join (or that were gossiped before the ring wrapped).
+func pullPeerSnapshot(peerAddr, selfId string) (uint64, []mutation, error) {
+	conn, reader, err := dialPeer(peerAddr, selfId)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("SYNC_SNAPSHOT\n")); err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := readFramedResponse(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var syncResp struct {
+		Epoch     uint64     `json:"epoch"`
+		Mutations []mutation `json:"mutations"`
+	}
+	if len(resp) > 0 {
+		if err := json.Unmarshal(resp, &syncResp); err != nil {
+			return 0, nil, err
+		}
+	}
+	return syncResp.Epoch, syncResp.Mutations, nil
+}
+
+// fetchPeerTopicHashes asks peerAddr for its per-topic Merkle-hash summary,
+// used by anti-entropy to find mismatched topics without pulling full
+// state for every one of them.
+func fetchPeerTopicHashes(peerAddr, selfId string) (map[string]string, error) {
+	conn, reader, err := dialPeer(peerAddr, selfId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("SYNC_HASHES\n")); err != nil {
+		return nil, err
+	}
+
+	resp, err := readFramedResponse(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string)
+	if len(resp) > 0 {
+		if err := json.Unmarshal(resp, &hashes); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// fetchPeerTopicState pulls the full mutation log peerAddr has retained for
+// a single topic, used once anti-entropy finds that topic's hash mismatched.
+func fetchPeerTopicState(peerAddr, selfId, topic string) ([]mutation, error) {
+	conn, reader, err := dialPeer(peerAddr, selfId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(fmt.Sprintf("SYNC_TOPIC %s\n", topic))); err != nil {
+		return nil, err
+	}
+
+	resp, err := readFramedResponse(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var mutations []mutation
+	if len(resp) > 0 {
+		if err := json.Unmarshal(resp, &mutations); err != nil {
+			return nil, err
+		}
+	}
+	return mutations, nil
+}
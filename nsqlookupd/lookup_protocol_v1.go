@@ -2,12 +2,14 @@ package nsqlookupd
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -25,6 +27,19 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 	var line string
 
 	client := NewClientV1(conn)
+
+	// the "  T1" magic hands us an already-wrapped *tls.Conn (see
+	// tcpServer.Handle); finish its handshake before reading any command so
+	// client.isTLS and the peer certificate are in place for AUTH/logging
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			nsqlookupLog.LogErrorf(" TLS handshake failed - %s", err)
+			return err
+		}
+		client.isTLS = true
+		markPeerCertificate(client, tlsConn)
+	}
+
 	reader := bufio.NewReader(client)
 	for {
 		line, err = reader.ReadString('\n')
@@ -82,6 +97,28 @@ func (p *LookupProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, params [
 		return p.REGISTER(client, reader, params[1:])
 	case "UNREGISTER":
 		return p.UNREGISTER(client, reader, params[1:])
+	case "AUTH":
+		return p.AUTH(client, reader, params[1:])
+	case "SUBSCRIBE":
+		return p.SUBSCRIBE(client, reader, params[1:])
+	case "REGISTER_MULTI":
+		return p.REGISTER_MULTI(client, reader, params[1:])
+	case "UNREGISTER_MULTI":
+		return p.UNREGISTER_MULTI(client, reader, params[1:])
+	case "PEER_IDENTIFY":
+		return p.PEER_IDENTIFY(client, reader, params[1:])
+	case "SYNC":
+		return p.SYNC(client, reader, params[1:])
+	case "SYNC_SNAPSHOT":
+		return p.SYNC_SNAPSHOT(client, params[1:])
+	case "SYNC_HASHES":
+		return p.SYNC_HASHES(client, params[1:])
+	case "SYNC_TOPIC":
+		return p.SYNC_TOPIC(client, params[1:])
+	case "TOMBSTONE":
+		return p.TOMBSTONE(client, params[1:])
+	case "GRACEFUL_SHUTDOWN":
+		return p.GRACEFUL_SHUTDOWN(client, params[1:])
 	}
 	return nil, protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
@@ -122,6 +159,18 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 		return nil, err
 	}
 
+	if client.NeedsAuthRefresh() {
+		if err := client.RefreshAuthorizations(p.ctx.nsqlookupd.opts.AuthHTTPAddresses,
+			p.ctx.nsqlookupd.opts.HTTPClientConnectTimeout, p.ctx.nsqlookupd.opts.HTTPClientRequestTimeout); err != nil {
+			nsqlookupLog.LogErrorf(" AUTH refresh failed for client(%s) - %s", client, err)
+		}
+	}
+
+	if client.authEnabled && !client.IsAuthorizedFor(topic, "register") {
+		return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("REGISTER topic %s not authorized", topic))
+	}
+
 	if channel != "" {
 		key := ChannelReg{
 			PartitionID: pid,
@@ -131,11 +180,13 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 		if p.ctx.nsqlookupd.DB.AddChannelReg(topic, key) {
 			nsqlookupLog.Logf("DB: client(%s) REGISTER new channel: topic:%s channel:%s pid:%s",
 				client, topic, channel, pid)
+			p.ctx.nsqlookupd.cluster.RecordLocal("add_channel", topic, pid, channel, client.peerInfo.Id)
 		}
 	}
 	if p.ctx.nsqlookupd.DB.AddTopicProducer(topic, pid, &Producer{peerInfo: client.peerInfo}) {
 		nsqlookupLog.Logf("DB: client(%s) REGISTER new topic:%s pid:%s",
 			client, topic, pid)
+		p.ctx.nsqlookupd.cluster.RecordLocal("add_producer", topic, pid, "", client.peerInfo.Id)
 	}
 
 	return []byte("OK"), nil
@@ -151,6 +202,18 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		return nil, err
 	}
 
+	if client.NeedsAuthRefresh() {
+		if err := client.RefreshAuthorizations(p.ctx.nsqlookupd.opts.AuthHTTPAddresses,
+			p.ctx.nsqlookupd.opts.HTTPClientConnectTimeout, p.ctx.nsqlookupd.opts.HTTPClientRequestTimeout); err != nil {
+			nsqlookupLog.LogErrorf(" AUTH refresh failed for client(%s) - %s", client, err)
+		}
+	}
+
+	if client.authEnabled && !client.IsAuthorizedFor(topic, "unregister") {
+		return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("UNREGISTER topic %s not authorized", topic))
+	}
+
 	if channel != "" {
 		key := ChannelReg{
 			PartitionID: pid,
@@ -162,6 +225,7 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		if removed {
 			nsqlookupLog.Logf("DB: client(%s) UNREGISTER channel %v on topic:%s-%v",
 				client, channel, topic, pid)
+			p.ctx.nsqlookupd.cluster.RecordLocal("remove_channel", topic, pid, channel, client.peerInfo.Id)
 		}
 	} else {
 		// no channel was specified so this is a topic unregistration
@@ -183,12 +247,140 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		if removed := p.ctx.nsqlookupd.DB.RemoveTopicProducer(topic, pid, client.peerInfo.Id); removed {
 			nsqlookupLog.Logf("DB: client(%s) UNREGISTER topic :%s pid:%s",
 				client, topic, pid)
+			p.ctx.nsqlookupd.cluster.RecordLocal("remove_producer", topic, pid, "", client.peerInfo.Id)
 		}
 	}
 
 	return []byte("OK"), nil
 }
 
+// readMultiBody reads the length-prefixed JSON body shared by REGISTER_MULTI
+// and UNREGISTER_MULTI and decodes it into a batch of entries.
+func readMultiBody(command string, reader *bufio.Reader) ([]MultiRegistration, error) {
+	var bodyLen int32
+	err := binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", command+" failed to read body size")
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", command+" failed to read body")
+	}
+
+	var entries []MultiRegistration
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &entries); err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", command+" failed to decode JSON body")
+		}
+	}
+	return entries, nil
+}
+
+// REGISTER_MULTI applies a batch of (topic, partition, channels) entries
+// under a single RegistrationDB lock acquisition, avoiding the lock
+// contention a reconnecting multi-partition producer would otherwise cause
+// by issuing one REGISTER per tuple. A non-empty payload is additive, same
+// as issuing one REGISTER per entry: it never removes anything this peer
+// already holds that the batch simply didn't mention. Only an empty
+// payload is treated as a full re-sync, clearing everything this peer
+// previously registered — the degenerate case where "what I hold" is
+// explicitly nothing.
+func (p *LookupProtocolV1) REGISTER_MULTI(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	entries, err := readMultiBody("REGISTER_MULTI", reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		p.ctx.nsqlookupd.DB.ResyncPeerRegistrations(client.peerInfo.Id, nil)
+		nsqlookupLog.Logf("DB: client(%s) REGISTER_MULTI empty payload, cleared all registrations", client)
+		p.ctx.nsqlookupd.cluster.RecordLocal("resync", "", "", "", client.peerInfo.Id)
+		return []byte("[]"), nil
+	}
+
+	statuses := make([]MultiStatus, 0, len(entries))
+	valid := make([]MultiRegistration, 0, len(entries))
+	for _, entry := range entries {
+		if client.authEnabled && !client.IsAuthorizedFor(entry.Topic, "register") {
+			statuses = append(statuses, MultiStatus{Topic: entry.Topic, PartitionID: entry.PartitionID,
+				Status: "E_UNAUTHORIZED", Error: "not authorized"})
+			continue
+		}
+		if verr := validateMultiRegistration("REGISTER_MULTI", entry); verr != nil {
+			statuses = append(statuses, MultiStatus{Topic: entry.Topic, PartitionID: entry.PartitionID,
+				Status: "ERROR", Error: verr.Error()})
+			continue
+		}
+		valid = append(valid, entry)
+		statuses = append(statuses, MultiStatus{Topic: entry.Topic, PartitionID: entry.PartitionID, Status: "OK"})
+	}
+
+	// additive: entries rejected above (auth or validation) are simply
+	// skipped, never removed, since this isn't a re-sync
+	p.ctx.nsqlookupd.DB.RegisterMultiEntries(client.peerInfo.Id, valid)
+	nsqlookupLog.Logf("DB: client(%s) REGISTER_MULTI added %d entries", client, len(valid))
+	for _, entry := range valid {
+		p.ctx.nsqlookupd.cluster.RecordLocal("add_producer", entry.Topic, entry.PartitionID, "", client.peerInfo.Id)
+	}
+
+	response, err := json.Marshal(statuses)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" marshaling %v", statuses)
+		return []byte("OK"), nil
+	}
+	return response, nil
+}
+
+// UNREGISTER_MULTI removes a batch of (topic, partition, channels) entries
+// under a single RegistrationDB lock acquisition. Unlike REGISTER_MULTI
+// this is not a re-sync: only the listed entries are removed.
+func (p *LookupProtocolV1) UNREGISTER_MULTI(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	entries, err := readMultiBody("UNREGISTER_MULTI", reader)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MultiStatus, 0, len(entries))
+	valid := make([]MultiRegistration, 0, len(entries))
+	for _, entry := range entries {
+		if client.authEnabled && !client.IsAuthorizedFor(entry.Topic, "unregister") {
+			statuses = append(statuses, MultiStatus{Topic: entry.Topic, PartitionID: entry.PartitionID,
+				Status: "E_UNAUTHORIZED", Error: "not authorized"})
+			continue
+		}
+		if verr := validateMultiRegistration("UNREGISTER_MULTI", entry); verr != nil {
+			statuses = append(statuses, MultiStatus{Topic: entry.Topic, PartitionID: entry.PartitionID,
+				Status: "ERROR", Error: verr.Error()})
+			continue
+		}
+		valid = append(valid, entry)
+		statuses = append(statuses, MultiStatus{Topic: entry.Topic, PartitionID: entry.PartitionID, Status: "OK"})
+	}
+
+	p.ctx.nsqlookupd.DB.RemoveMulti(client.peerInfo.Id, valid)
+	nsqlookupLog.Logf("DB: client(%s) UNREGISTER_MULTI removed %d entries", client, len(valid))
+	for _, entry := range valid {
+		p.ctx.nsqlookupd.cluster.RecordLocal("remove_producer", entry.Topic, entry.PartitionID, "", client.peerInfo.Id)
+	}
+
+	response, err := json.Marshal(statuses)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" marshaling %v", statuses)
+		return []byte("OK"), nil
+	}
+	return response, nil
+}
+
 func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
 	var err error
 
@@ -216,6 +408,15 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to decode JSON body")
 	}
 
+	// tls_v1 is carried alongside PeerInfo rather than as a field on it so
+	// that peerInfo's "require all fields" check below stays unaffected
+	var tlsFeature struct {
+		TLSv1 bool `json:"tls_v1"`
+	}
+	if err = json.Unmarshal(body, &tlsFeature); err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to decode JSON body")
+	}
+
 	peerInfo.RemoteAddress = client.RemoteAddr().String()
 
 	// require all fields
@@ -234,6 +435,13 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 		nsqlookupLog.Logf("DB: client(%s) REGISTER new peer", client)
 	}
 
+	// if an auth HTTP address is configured, the peer must AUTH before any
+	// REGISTER/UNREGISTER will be accepted; mark it unauthenticated until
+	// it does
+	if len(p.ctx.nsqlookupd.opts.AuthHTTPAddresses) > 0 {
+		client.authEnabled = true
+	}
+
 	// build a response
 	data := make(map[string]interface{})
 	data["tcp_port"] = p.ctx.nsqlookupd.RealTCPAddr().Port
@@ -245,12 +453,36 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	}
 	data["broadcast_address"] = p.ctx.nsqlookupd.opts.BroadcastAddress
 	data["hostname"] = hostname
+	data["auth_required"] = client.authEnabled
+
+	var tlsConfig *tls.Config
+	if tlsFeature.TLSv1 {
+		tlsConfig, err = buildTLSConfig(p.ctx.nsqlookupd.opts)
+		if err != nil || tlsConfig == nil {
+			return nil, protocol.NewFatalClientErr(err, "E_TLS_NOT_CONFIGURED", "TLS not configured")
+		}
+		data["tls_v1"] = true
+	}
 
 	response, err := json.Marshal(data)
 	if err != nil {
 		nsqlookupLog.LogErrorf(" marshaling %v", data)
 		return []byte("OK"), nil
 	}
+
+	if tlsConfig != nil {
+		// the peer needs this response before it can start its side of the
+		// handshake, so flush it now rather than letting IOLoop send it
+		// after we've already swapped the conn out from under it
+		if _, err = protocol.SendResponse(client, response); err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_TLS_FAILED", "failed to send IDENTIFY response")
+		}
+		if err = client.UpgradeTLS(tlsConfig); err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_TLS_FAILED", "TLS handshake failed")
+		}
+		return nil, nil
+	}
+
 	return response, nil
 }
 
@@ -265,3 +497,323 @@ func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, erro
 	}
 	return []byte("OK"), nil
 }
+
+// AUTH exchanges a client-supplied secret for a set of cached authorizations
+// by querying the configured auth HTTP endpoint, mirroring nsqd's AUTH flow.
+// REGISTER/UNREGISTER are rejected with E_UNAUTHORIZED until this succeeds
+// when the lookupd is running with --auth-http-address.
+func (p *LookupProtocolV1) AUTH(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	if len(p.ctx.nsqlookupd.opts.AuthHTTPAddresses) == 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_AUTH_DISABLED", "AUTH disabled")
+	}
+
+	if client.HasAuthorizations() {
+		return nil, protocol.NewFatalClientErr(nil, "E_AUTH_ALREADY_SENT", "AUTH already sent")
+	}
+
+	var bodyLen int32
+	err := binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "AUTH failed to read body size")
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "AUTH failed to read body")
+	}
+	secret := string(body)
+
+	remoteIP, _, err := net.SplitHostPort(client.RemoteAddr().String())
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_AUTH_FAILED", "AUTH unable to determine remote address")
+	}
+
+	authorizations, err := queryAuthd(p.ctx.nsqlookupd.opts.AuthHTTPAddresses, remoteIP, client.isTLS, secret,
+		p.ctx.nsqlookupd.opts.HTTPClientConnectTimeout, p.ctx.nsqlookupd.opts.HTTPClientRequestTimeout)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" AUTH failed for client(%s) - %s", client, err)
+		return nil, protocol.NewFatalClientErr(err, "E_AUTH_FAILED", "AUTH failed")
+	}
+
+	// authEnabled stays true for the life of the connection: it just means
+	// "this lookupd requires AUTH", not "AUTH hasn't happened yet". Every
+	// REGISTER/UNREGISTER/etc. gate still consults IsAuthorizedFor, which
+	// enforces whatever (possibly empty) set of authorizations authd
+	// granted, including TTL expiry.
+	client.SetAuthorizations(authorizations)
+	client.authSecret = secret
+	client.authRemoteIP = remoteIP
+
+	nsqlookupLog.Logf("CLIENT(%s): AUTH granted %d authorizations", client, len(authorizations))
+
+	return []byte("OK"), nil
+}
+
+// SUBSCRIBE flips the connection from the normal request/response loop into
+// a long-lived push mode: the client receives a framed JSON notification
+// event every time RegistrationDB adds or removes a producer/channel for
+// topic (or for any topic, if topic is "*"), plus a periodic heartbeat.
+// This never returns except on write failure or disconnect, at which point
+// IOLoop tears down the connection as usual.
+//
+// Unlike REGISTER/UNREGISTER, SUBSCRIBE does not require IDENTIFY: it's
+// consumer SDKs watching for producer changes that call it, and a consumer
+// has no producer identity to offer — IDENTIFY's required fields
+// (BroadcastAddress/TCPPort/HTTPPort) describe a producer, and
+// addPeerClient would register a bogus producer in RegistrationDB if a
+// consumer were forced through it just to reach SUBSCRIBE.
+func (p *LookupProtocolV1) SUBSCRIBE(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if len(params) < 1 || params[0] == "" {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "SUBSCRIBE insufficient number of params")
+	}
+
+	topic := params[0]
+	if topic != "*" && !protocol.IsValidTopicName(topic) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC", fmt.Sprintf("SUBSCRIBE topic name '%s' is not valid", topic))
+	}
+
+	sub := newSubscriber(topic, client)
+	p.ctx.nsqlookupd.DB.subscribers.Add(sub)
+	defer p.ctx.nsqlookupd.DB.subscribers.Remove(sub)
+
+	nsqlookupLog.Logf("CLIENT(%s): SUBSCRIBE topic:%s", client, topic)
+
+	heartbeat := time.NewTicker(subscriberHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case frame := <-sub.queue:
+			if _, err := protocol.SendResponse(client, frame); err != nil {
+				return nil, protocol.NewFatalClientErr(err, "E_SUBSCRIBE_FAILED", "failed to write notification")
+			}
+		case <-heartbeat.C:
+			if _, err := protocol.SendResponse(client, []byte("_heartbeat_")); err != nil {
+				return nil, protocol.NewFatalClientErr(err, "E_SUBSCRIBE_FAILED", "failed to write heartbeat")
+			}
+		}
+	}
+}
+
+// PEER_IDENTIFY is the cluster-gossip handshake a peer nsqlookupd performs
+// before SYNC/SYNC_HASHES/SYNC_TOPIC, analogous to how a producer performs
+// IDENTIFY before REGISTER. It only records which peer_id this connection
+// speaks for; it does not require IDENTIFY, since peer connections are a
+// distinct, unauthenticated-by-default link between lookupd instances.
+func (p *LookupProtocolV1) PEER_IDENTIFY(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	var bodyLen int32
+	if err := binary.Read(reader, binary.BigEndian, &bodyLen); err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "PEER_IDENTIFY failed to read body size")
+	}
+
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "PEER_IDENTIFY failed to read body")
+	}
+
+	var req struct {
+		PeerId string `json:"peer_id"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.PeerId == "" {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "PEER_IDENTIFY missing peer_id")
+	}
+
+	client.clusterPeerId = req.PeerId
+	nsqlookupLog.Logf("CLUSTER: peer(%s) identified as %s", client, req.PeerId)
+
+	return []byte("OK"), nil
+}
+
+// SYNC returns every mutation this peer has recorded with seq > since_seq,
+// tagged with this peer's current ring epoch, for the calling peer to apply
+// via cluster.applyReplicated. The caller must compare the returned epoch
+// against the one it last saw for us: a mismatch means we've restarted
+// since then and our seq counter reset to 0, so the since_seq the caller
+// sent is meaningless and it must re-pull from 0 instead of trusting
+// whatever this call happened to return against it. An empty mutations
+// list with ok=false (reported to the caller as an empty array) means
+// since_seq has fallen out of the retained ring; the caller is expected to
+// fall back to SYNC_HASHES/SYNC_TOPIC anti-entropy.
+func (p *LookupProtocolV1) SYNC(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.clusterPeerId == "" {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must PEER_IDENTIFY")
+	}
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "SYNC insufficient number of params")
+	}
+	if p.ctx.nsqlookupd.cluster == nil {
+		// --lookupd-peer isn't configured on this instance: there's no ring
+		// to have recorded anything in, so there's nothing to sync
+		return []byte(`{"epoch":0,"mutations":[]}`), nil
+	}
+
+	since, err := strconv.ParseUint(params[1], 10, 64)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_INVALID", "SYNC invalid since_seq")
+	}
+
+	epoch, mutations, ok := p.ctx.nsqlookupd.cluster.ring.Since(since)
+	if !ok {
+		mutations = []mutation{}
+	}
+
+	syncResp := struct {
+		Epoch     uint64     `json:"epoch"`
+		Mutations []mutation `json:"mutations"`
+	}{Epoch: epoch, Mutations: mutations}
+
+	response, err := json.Marshal(syncResp)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" marshaling %v", syncResp)
+		return []byte(`{"epoch":0,"mutations":[]}`), nil
+	}
+	return response, nil
+}
+
+// SYNC_SNAPSHOT returns a full mutation snapshot of every topic this peer
+// currently holds, tagged with its current ring epoch. Unlike SYNC, which
+// only replays recent deltas, this gives a joining or previously-unsynced
+// peer the complete picture in one call — the mutation ring never retains
+// registrations made before a peer started watching it, so a cold-start
+// peer pulling "since 0" from the ring would otherwise see nothing for
+// anything registered before it joined.
+func (p *LookupProtocolV1) SYNC_SNAPSHOT(client *ClientV1, params []string) ([]byte, error) {
+	if client.clusterPeerId == "" {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must PEER_IDENTIFY")
+	}
+
+	var epoch uint64
+	if p.ctx.nsqlookupd.cluster != nil {
+		epoch = p.ctx.nsqlookupd.cluster.ring.epoch
+	}
+
+	syncResp := struct {
+		Epoch     uint64     `json:"epoch"`
+		Mutations []mutation `json:"mutations"`
+	}{Epoch: epoch, Mutations: p.ctx.nsqlookupd.DB.AllSnapshotMutations()}
+
+	response, err := json.Marshal(syncResp)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" marshaling %v", syncResp)
+		return []byte(`{"epoch":0,"mutations":[]}`), nil
+	}
+	return response, nil
+}
+
+// SYNC_HASHES returns a per-topic Merkle-hash summary of this peer's
+// RegistrationDB state, letting the caller's anti-entropy pass find which
+// topics disagree without pulling full state for every topic.
+func (p *LookupProtocolV1) SYNC_HASHES(client *ClientV1, params []string) ([]byte, error) {
+	hashes := p.ctx.nsqlookupd.DB.TopicMerkleHashes()
+	response, err := json.Marshal(hashes)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" marshaling %v", hashes)
+		return []byte("{}"), nil
+	}
+	return response, nil
+}
+
+// SYNC_TOPIC returns a full mutation snapshot of a single topic's current
+// RegistrationDB state, used once SYNC_HASHES has identified it as
+// mismatched between two peers.
+func (p *LookupProtocolV1) SYNC_TOPIC(client *ClientV1, params []string) ([]byte, error) {
+	if len(params) < 1 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "SYNC_TOPIC insufficient number of params")
+	}
+
+	mutations := p.ctx.nsqlookupd.DB.TopicSnapshotMutations(params[0])
+	response, err := json.Marshal(mutations)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" marshaling %v", mutations)
+		return []byte("[]"), nil
+	}
+	return response, nil
+}
+
+// TOMBSTONE gives a producer a TCP-side way to say "stop routing consumers
+// to me for this one partition" without an HTTP call, reusing the same
+// tombstone TTL mechanism nsqlookupd's HTTP /tombstone_topic_producer
+// already applies: /lookup stops returning the entry immediately while
+// existing consumers finish draining it.
+func (p *LookupProtocolV1) TOMBSTONE(client *ClientV1, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "TOMBSTONE insufficient number of params")
+	}
+
+	topic := params[0]
+	pid := params[1]
+
+	if !protocol.IsValidTopicName(topic) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC", fmt.Sprintf("TOMBSTONE topic name '%s' is not valid", topic))
+	}
+	if _, err := GetValidPartitionID(pid); err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_PARTITIONID", fmt.Sprintf("TOMBSTONE partition id '%s' is not valid", pid))
+	}
+
+	if client.authEnabled && !client.IsAuthorizedFor(topic, "unregister") {
+		return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED", fmt.Sprintf("TOMBSTONE topic %s not authorized", topic))
+	}
+
+	p.ctx.nsqlookupd.DB.TombstoneTopicProducer(topic, pid, client.peerInfo.Id)
+	nsqlookupLog.Logf("DB: client(%s) TOMBSTONE topic:%s pid:%s", client, topic, pid)
+	p.ctx.nsqlookupd.cluster.RecordLocal("tombstone_producer", topic, pid, "", client.peerInfo.Id)
+
+	return []byte("OK"), nil
+}
+
+// GRACEFUL_SHUTDOWN tombstones every (topic, partition) this peer currently
+// holds, waits the operator-configured drain window so in-flight consumers
+// stop being routed here, then removes the peer from RegistrationDB
+// entirely and closes the connection. Paired with a SIGTERM handler in
+// nsqd that sends GRACEFUL_SHUTDOWN before exiting, this closes the
+// ~30-second window where a rolling restart could still route a consumer
+// to a node that's already gone.
+//
+// Because peerInfo.Id is whatever the client claimed at IDENTIFY, this is
+// just as spoofable as TOMBSTONE if left unchecked: it's gated the same
+// way, by requiring authorization to unregister every topic it's about to
+// tombstone before touching RegistrationDB.
+func (p *LookupProtocolV1) GRACEFUL_SHUTDOWN(client *ClientV1, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	topics := p.ctx.nsqlookupd.DB.TopicsHeldByPeer(client.peerInfo.Id)
+	if client.authEnabled {
+		for _, topic := range topics {
+			if !client.IsAuthorizedFor(topic, "unregister") {
+				return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+					fmt.Sprintf("GRACEFUL_SHUTDOWN topic %s not authorized", topic))
+			}
+		}
+	}
+
+	n := p.ctx.nsqlookupd.DB.TombstoneAllByPeerId(client.peerInfo.Id)
+	nsqlookupLog.Logf("CLIENT(%s): GRACEFUL_SHUTDOWN tombstoned %d entries, draining for %s",
+		client, n, p.ctx.nsqlookupd.opts.GracefulShutdownDrainDuration)
+	for _, topic := range topics {
+		p.ctx.nsqlookupd.cluster.RecordLocal("tombstone_producer", topic, "", "", client.peerInfo.Id)
+	}
+
+	time.Sleep(p.ctx.nsqlookupd.opts.GracefulShutdownDrainDuration)
+
+	p.ctx.nsqlookupd.DB.RemoveAllByPeerId(client.peerInfo.Id)
+	nsqlookupLog.Logf("CLIENT(%s): GRACEFUL_SHUTDOWN complete, closing", client)
+	p.ctx.nsqlookupd.cluster.RecordLocal("resync", "", "", "", client.peerInfo.Id)
+
+	// the client is going away for good; send OK then close ourselves so
+	// IOLoop's next read fails and tears the connection down, rather than
+	// waiting on the peer to hang up first
+	_, err := protocol.SendResponse(client, []byte("OK"))
+	client.Close()
+	return nil, err
+}
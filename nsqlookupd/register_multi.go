@@ -0,0 +1,45 @@
+package nsqlookupd
+
+import "github.com/absolute8511/nsq/internal/protocol"
+
+// MultiRegistration is one (topic, partition, channels) entry in a
+// REGISTER_MULTI/UNREGISTER_MULTI batch body.
+type MultiRegistration struct {
+	Topic       string   `json:"topic"`
+	PartitionID string   `json:"partition_id"`
+	Channels    []string `json:"channels"`
+}
+
+// MultiStatus is the per-entry result returned for a REGISTER_MULTI or
+// UNREGISTER_MULTI batch; a malformed or rejected entry doesn't fail the
+// whole batch, it just reports its own status.
+//
+// RegistrationDB.RegisterMultiEntries, ResyncPeerRegistrations (called
+// only for an empty REGISTER_MULTI payload), and RemoveMulti — the
+// atomic, single-lock-acquisition counterparts these batch commands call
+// into — live alongside AddTopicProducer/RemoveChannelReg in
+// registration_db.go.
+type MultiStatus struct {
+	Topic       string `json:"topic"`
+	PartitionID string `json:"partition_id"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+func validateMultiRegistration(command string, entry MultiRegistration) error {
+	if !protocol.IsValidTopicName(entry.Topic) {
+		return protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			command+" topic name '"+entry.Topic+"' is not valid")
+	}
+	if _, err := GetValidPartitionID(entry.PartitionID); err != nil {
+		return protocol.NewFatalClientErr(nil, "E_BAD_PARTITIONID",
+			command+" partition id '"+entry.PartitionID+"' is not valid")
+	}
+	for _, channel := range entry.Channels {
+		if channel != "" && !protocol.IsValidChannelName(channel) {
+			return protocol.NewFatalClientErr(nil, "E_BAD_CHANNEL",
+				command+" channel name '"+channel+"' is not valid")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package nsqlookupd
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// subscriberSendQueueSize bounds how many pending notification frames a
+// SUBSCRIBE connection may accumulate before it is considered too slow to
+// keep up and is dropped. Polling clients don't hit this; only a subscriber
+// wedged behind a slow network or a stalled reader can.
+const subscriberSendQueueSize = 100
+
+// subscriberHeartbeatInterval is how often an idle SUBSCRIBE connection
+// receives a heartbeat frame so it (and any intervening proxy) can detect a
+// half-open socket.
+const subscriberHeartbeatInterval = 30 * time.Second
+
+// notificationEvent is the JSON frame pushed to SUBSCRIBE connections
+// whenever RegistrationDB mutates a topic the subscriber cares about.
+type notificationEvent struct {
+	Type        string `json:"type"`
+	Topic       string `json:"topic"`
+	PartitionID string `json:"partition_id,omitempty"`
+	Channel     string `json:"channel,omitempty"`
+	PeerId      string `json:"peer_id,omitempty"`
+}
+
+// subscriber is a single SUBSCRIBE connection's outgoing queue. Sends are
+// non-blocking: a subscriber that can't keep up is disconnected rather than
+// allowed to backpressure DB mutations for every other client.
+type subscriber struct {
+	topic  string // topic name, or "*" for all topics
+	client *ClientV1
+	queue  chan []byte
+}
+
+func newSubscriber(topic string, client *ClientV1) *subscriber {
+	return &subscriber{
+		topic:  topic,
+		client: client,
+		queue:  make(chan []byte, subscriberSendQueueSize),
+	}
+}
+
+func (s *subscriber) matches(topic string) bool {
+	return s.topic == "*" || s.topic == topic
+}
+
+// enqueue attempts a non-blocking send of the event frame; it reports false
+// if the subscriber's queue is full, signaling the caller to drop it.
+func (s *subscriber) enqueue(event *notificationEvent) bool {
+	frame, err := json.Marshal(event)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" failed to marshal notification event %v - %s", event, err)
+		return true
+	}
+	select {
+	case s.queue <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// subscriberRegistry fans out RegistrationDB mutations to all subscribers
+// whose topic filter matches. RegistrationDB.AddTopicProducer,
+// RemoveTopicProducer, AddChannelReg, and RemoveChannelReg each call
+// Notify after a mutation actually changes state, so that SUBSCRIBE
+// connections see changes in real time instead of polling /lookup.
+type subscriberRegistry struct {
+	sync.RWMutex
+	subscribers map[*subscriber]struct{}
+}
+
+func newSubscriberRegistry() *subscriberRegistry {
+	return &subscriberRegistry{
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+func (r *subscriberRegistry) Add(s *subscriber) {
+	r.Lock()
+	defer r.Unlock()
+	r.subscribers[s] = struct{}{}
+}
+
+func (r *subscriberRegistry) Remove(s *subscriber) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.subscribers, s)
+}
+
+// Notify fans event out to every matching subscriber, dropping (and
+// disconnecting) any whose queue is full.
+func (r *subscriberRegistry) Notify(event *notificationEvent) {
+	r.RLock()
+	dead := make([]*subscriber, 0)
+	for s := range r.subscribers {
+		if !s.matches(event.Topic) {
+			continue
+		}
+		if !s.enqueue(event) {
+			dead = append(dead, s)
+		}
+	}
+	r.RUnlock()
+
+	for _, s := range dead {
+		nsqlookupLog.LogErrorf(" SUBSCRIBE client(%s) exceeded send queue, disconnecting", s.client)
+		r.Remove(s)
+		s.client.Close()
+	}
+}
@@ -0,0 +1,60 @@
+package nsqlookupd
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/absolute8511/nsq/internal/protocol"
+)
+
+// tcpServer dispatches an accepted connection to the right protocol
+// implementation based on its 4-byte magic prefix. "  T1" is the TLS
+// variant of the existing lookup protocol: the raw conn is wrapped in a
+// TLS server conn before any command is read, letting nsqd register over
+// an untrusted network without an external TCP proxy. LookupProtocolV1.IOLoop
+// detects the wrapped *tls.Conn, finishes its handshake, and marks the
+// client accordingly (isTLS, peer certificate) before serving any command.
+// Most deployments instead negotiate TLS in-band via IDENTIFY's tls_v1
+// feature (see ClientV1.UpgradeTLS); the magic exists for operators who
+// want TLS enforced before the peer can send anything at all.
+type tcpServer struct {
+	ctx *Context
+}
+
+func (p *tcpServer) Handle(clientConn net.Conn) {
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(clientConn, buf)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" failed to read protocol version - %s", err)
+		clientConn.Close()
+		return
+	}
+	protocolMagic := string(buf)
+
+	switch protocolMagic {
+	case "  V1":
+		p.serve(clientConn)
+	case "  T1":
+		tlsConfig, err := buildTLSConfig(p.ctx.nsqlookupd.opts)
+		if err != nil || tlsConfig == nil {
+			nsqlookupLog.LogErrorf(" TLS not configured, rejecting '%s' connection", protocolMagic)
+			protocol.SendResponse(clientConn, []byte("E_BAD_PROTOCOL"))
+			clientConn.Close()
+			return
+		}
+		p.serve(tls.Server(clientConn, tlsConfig))
+	default:
+		protocol.SendResponse(clientConn, []byte("E_BAD_PROTOCOL"))
+		clientConn.Close()
+		nsqlookupLog.LogErrorf(" client(%s) bad protocol magic '%s'", clientConn.RemoteAddr(), protocolMagic)
+	}
+}
+
+func (p *tcpServer) serve(conn net.Conn) {
+	prot := &LookupProtocolV1{ctx: p.ctx}
+	err := prot.IOLoop(conn)
+	if err != nil {
+		nsqlookupLog.LogErrorf(" client(%s) - %s", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,83 @@
+package nsqlookupd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// buildTLSConfig turns the lookupd's --tls-* options into a *tls.Config,
+// mirroring nsqd's TLS setup so that nsqd->nsqlookupd registration can be
+// upgraded to TLS the same way client->nsqd connections are.
+func buildTLSConfig(opts *Options) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+
+	if opts.TLSCert == "" && opts.TLSKey == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS10,
+	}
+
+	switch opts.TLSClientAuthPolicy {
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	case "require-verify":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	}
+
+	if opts.TLSRootCAFile != "" {
+		tlsCertPool := x509.NewCertPool()
+		caCertFile, err := ioutil.ReadFile(opts.TLSRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
+			return nil, fmt.Errorf("failed to append certificate to pool")
+		}
+		tlsConfig.ClientCAs = tlsCertPool
+	}
+
+	tlsConfig.BuildNameToCertificate()
+
+	return tlsConfig, nil
+}
+
+// UpgradeTLS performs an in-band TLS handshake over the client's existing
+// conn, swapping it for the negotiated tls.Conn. Called from IDENTIFY once
+// the "tls_v1" response frame has been flushed to the peer, mirroring
+// nsqd's IDENTIFY-negotiated TLS upgrade.
+func (c *ClientV1) UpgradeTLS(tlsConfig *tls.Config) error {
+	tlsConn := tls.Server(c.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.isTLS = true
+	markPeerCertificate(c, tlsConn)
+	return nil
+}
+
+// markPeerCertificate records the certificate chain the peer presented (if
+// any) on c; the chain is verified only under the "require-verify" client
+// auth policy. This lets handlers downstream of a TLS
+// upgrade — logging, AUTH, authorization decisions — see the peer's
+// certificate identity rather than just "this connection is over TLS".
+// Shared by both the in-band IDENTIFY tls_v1 upgrade and the "  T1" magic
+// path in tcp_server.go, since both end up with a handshaked *tls.Conn.
+func markPeerCertificate(c *ClientV1, tlsConn *tls.Conn) {
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) > 0 {
+		c.peerCertificates = state.PeerCertificates
+	}
+}